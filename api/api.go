@@ -0,0 +1,75 @@
+// Package api defines the wire protocol between the mpbuild daemon and its
+// clients (the plain CLI and mpbuildctl). It mirrors the RPCs sketched in
+// mpbuild.proto as newline-delimited JSON frames over a unix socket, since
+// this tree has no protoc/grpc toolchain to generate real stubs from it.
+package api
+
+import "encoding/json"
+
+// Command names, sent as the first frame of every connection.
+const (
+	CmdSubmit      = "submit"
+	CmdGetStatus   = "status"
+	CmdStreamLogs  = "logs"
+	CmdCancel      = "cancel"
+	CmdListRunning = "list"
+)
+
+// Request is the single frame a client sends to open an RPC.
+type Request struct {
+	Cmd     string `json:"cmd"`
+	JobPath string `json:"job_path,omitempty"`
+	Config  string `json:"config,omitempty"`
+	// JobJSON, when set, is an already-decoded (and possibly
+	// --start/--only/--not/--deps filtered) Job marshalled by the caller,
+	// used instead of re-reading and re-decoding JobPath. The plain
+	// `mpbuild <jobfile>` CLI path submits this way so the filters it
+	// already applied to the in-memory Job aren't lost by having the
+	// daemon load its own fresh copy from JobPath.
+	JobJSON    json.RawMessage `json:"job_json,omitempty"`
+	JobID      string          `json:"job_id,omitempty"`
+	TaskFilter int             `json:"task_filter,omitempty"`
+}
+
+// SubmitReply answers CmdSubmit.
+type SubmitReply struct {
+	JobID string `json:"job_id"`
+	Error string `json:"error,omitempty"`
+}
+
+// TaskStatus is one Task's state as reported by CmdGetStatus.
+type TaskStatus struct {
+	ID        int    `json:"id"`
+	Messages  string `json:"messages"`
+	Completed bool   `json:"completed"`
+	Running   bool   `json:"running"`
+	Failed    bool   `json:"failed"`
+}
+
+// StatusReply answers CmdGetStatus.
+type StatusReply struct {
+	JobID string       `json:"job_id"`
+	Tasks []TaskStatus `json:"tasks"`
+	Done  bool         `json:"done"`
+	Error string       `json:"error,omitempty"`
+}
+
+// LogChunk is one frame of a CmdStreamLogs response; the daemon keeps
+// writing these (newline-delimited) until the job is done or the client
+// disconnects.
+type LogChunk struct {
+	TaskID int    `json:"task_id"`
+	Chunk  string `json:"chunk"`
+	Done   bool   `json:"done,omitempty"`
+}
+
+// CancelReply answers CmdCancel.
+type CancelReply struct {
+	OK    bool   `json:"ok"`
+	Error string `json:"error,omitempty"`
+}
+
+// ListReply answers CmdListRunning.
+type ListReply struct {
+	IDs []string `json:"ids"`
+}
@@ -0,0 +1,173 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net"
+	"os"
+	"strings"
+
+	"github.com/apex/log"
+	"github.com/aubonbeurre/mpbuild/api"
+)
+
+// defaultDaemonAddr is where both `mpbuild daemon` and the plain CLI path
+// look for a socket when --listen isn't given.
+const defaultDaemonAddr = "unix:///tmp/mpbuild.sock"
+
+func dialDaemon(addr string) (net.Conn, error) {
+	return net.Dial("unix", strings.TrimPrefix(addr, "unix://"))
+}
+
+// ensureDaemon returns a socket address a job can be submitted to: the
+// daemon already listening at gOpts.Listen (or the default socket) if one
+// is up, or an ephemeral supervisor bound to a private socket in this same
+// process otherwise. Either way the plain `mpbuild <jobfile>` path becomes
+// a thin client speaking the same wire protocol as `mpbuildctl` and
+// `mpbuild daemon`, instead of running the build in-process directly.
+func ensureDaemon() (addr string, cleanup func(), err error) {
+	addr = gOpts.Listen
+	if addr == "" {
+		addr = defaultDaemonAddr
+	}
+
+	if conn, derr := dialDaemon(addr); derr == nil {
+		conn.Close()
+		return addr, func() {}, nil
+	}
+
+	sockPath := fmt.Sprintf("%s/mpbuild-%d.sock", os.TempDir(), os.Getpid())
+	os.Remove(sockPath)
+
+	listener, err := net.Listen("unix", sockPath)
+	if err != nil {
+		return "", nil, err
+	}
+
+	sup := newSupervisor()
+	go func() {
+		for {
+			conn, aerr := listener.Accept()
+			if aerr != nil {
+				return
+			}
+			go sup.handleConn(conn)
+		}
+	}()
+
+	cleanup = func() {
+		listener.Close()
+		os.Remove(sockPath)
+	}
+	return "unix://" + sockPath, cleanup, nil
+}
+
+// submitJob sends a CmdSubmit carrying an already-decoded (and filtered)
+// job as raw JSON, so the daemon doesn't need to re-read/re-filter jobPath.
+func submitJob(addr string, jobJSON []byte, config string) (string, error) {
+	conn, err := dialDaemon(addr)
+	if err != nil {
+		return "", err
+	}
+	defer conn.Close()
+
+	req := api.Request{Cmd: api.CmdSubmit, JobJSON: jobJSON, Config: config}
+	if err := json.NewEncoder(conn).Encode(req); err != nil {
+		return "", err
+	}
+
+	var reply api.SubmitReply
+	if err := json.NewDecoder(conn).Decode(&reply); err != nil {
+		return "", err
+	}
+	if reply.Error != "" {
+		return "", fmt.Errorf("%s", reply.Error)
+	}
+	return reply.JobID, nil
+}
+
+// streamJob tails jobID's log chunks until the daemon signals it's done,
+// echoing each line the same way workerStdout does for an in-process run,
+// then asks once more for the final status to surface a build error (if
+// any) back to main(), since LogChunk itself carries no pass/fail.
+func streamJob(addr, jobID string) error {
+	conn, err := dialDaemon(addr)
+	if err != nil {
+		return err
+	}
+
+	req := api.Request{Cmd: api.CmdStreamLogs, JobID: jobID}
+	if err := json.NewEncoder(conn).Encode(req); err != nil {
+		conn.Close()
+		return err
+	}
+
+	dec := json.NewDecoder(conn)
+	for {
+		var chunk api.LogChunk
+		if err := dec.Decode(&chunk); err != nil {
+			break
+		}
+		if chunk.Done {
+			break
+		}
+		if chunk.Chunk != "" {
+			log.WithFields(log.Fields{"task_id": chunk.TaskID}).Info(chunk.Chunk)
+		}
+	}
+	conn.Close()
+
+	return fetchJobErr(addr, jobID)
+}
+
+func fetchJobErr(addr, jobID string) error {
+	conn, err := dialDaemon(addr)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+
+	req := api.Request{Cmd: api.CmdGetStatus, JobID: jobID}
+	if err := json.NewEncoder(conn).Encode(req); err != nil {
+		return err
+	}
+
+	var reply api.StatusReply
+	if err := json.NewDecoder(conn).Decode(&reply); err != nil {
+		return err
+	}
+	if reply.Error != "" {
+		return fmt.Errorf("%s", reply.Error)
+	}
+	return nil
+}
+
+// submitAndWait routes a build through the daemon/client plumbing in
+// daemon.go/api instead of calling run() directly: it dials an
+// already-running daemon if one is listening at gOpts.Listen (or the
+// default socket), or stands up an ephemeral in-process one otherwise.
+//
+// This covers the plain (non --ui) CLI path. --ui still drives run()
+// in-process via runWithDashboard, since the wire protocol only streams
+// log lines today, not the task-lifecycle events (stage/worker/elapsed)
+// the dashboard needs - teaching the dashboard to consume a remote job
+// is left for a follow-up.
+func submitAndWait(job *Job, config string) error {
+	addr, cleanup, err := ensureDaemon()
+	if err != nil {
+		return err
+	}
+	defer cleanup()
+
+	jobJSON, err := json.Marshal(job)
+	if err != nil {
+		return err
+	}
+
+	jobID, err := submitJob(addr, jobJSON, config)
+	if err != nil {
+		return err
+	}
+
+	return streamJob(addr, jobID)
+}
@@ -0,0 +1,165 @@
+// Command mpbuildctl is a thin client for a running `mpbuild daemon`: it
+// submits jobs, polls status, tails logs and cancels in-flight builds over
+// the daemon's unix socket.
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+
+	"github.com/aubonbeurre/mpbuild/api"
+)
+
+func usage() {
+	fmt.Fprintln(os.Stderr, "usage: mpbuildctl <socket> submit <job.json> [config]")
+	fmt.Fprintln(os.Stderr, "       mpbuildctl <socket> status <job-id>")
+	fmt.Fprintln(os.Stderr, "       mpbuildctl <socket> logs <job-id> [task-id]")
+	fmt.Fprintln(os.Stderr, "       mpbuildctl <socket> cancel <job-id>")
+	fmt.Fprintln(os.Stderr, "       mpbuildctl <socket> list")
+	os.Exit(1)
+}
+
+func dial(addr string) (net.Conn, error) {
+	return net.Dial("unix", strings.TrimPrefix(addr, "unix://"))
+}
+
+func main() {
+	if len(os.Args) < 3 {
+		usage()
+	}
+	addr, cmd, args := os.Args[1], os.Args[2], os.Args[3:]
+
+	var err error
+	switch cmd {
+	case "submit":
+		if len(args) < 1 {
+			usage()
+		}
+		config := "Debug"
+		if len(args) > 1 {
+			config = args[1]
+		}
+		err = submit(addr, args[0], config)
+	case "status":
+		if len(args) < 1 {
+			usage()
+		}
+		err = status(addr, args[0])
+	case "logs":
+		if len(args) < 1 {
+			usage()
+		}
+		taskFilter := 0
+		if len(args) > 1 {
+			taskFilter, _ = strconv.Atoi(args[1])
+		}
+		err = tailLogs(addr, args[0], taskFilter)
+	case "cancel":
+		if len(args) < 1 {
+			usage()
+		}
+		err = cancel(addr, args[0])
+	case "list":
+		err = list(addr)
+	default:
+		usage()
+	}
+
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "mpbuildctl: %v\n", err)
+		os.Exit(1)
+	}
+}
+
+func roundTrip(addr string, req api.Request, reply interface{}) error {
+	conn, err := dial(addr)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+
+	if err := json.NewEncoder(conn).Encode(req); err != nil {
+		return err
+	}
+	return json.NewDecoder(conn).Decode(reply)
+}
+
+func submit(addr, jobPath, config string) error {
+	var reply api.SubmitReply
+	if err := roundTrip(addr, api.Request{Cmd: api.CmdSubmit, JobPath: jobPath, Config: config}, &reply); err != nil {
+		return err
+	}
+	if reply.Error != "" {
+		return fmt.Errorf("%s", reply.Error)
+	}
+	fmt.Println(reply.JobID)
+	return nil
+}
+
+func status(addr, jobID string) error {
+	var reply api.StatusReply
+	if err := roundTrip(addr, api.Request{Cmd: api.CmdGetStatus, JobID: jobID}, &reply); err != nil {
+		return err
+	}
+	if reply.Error != "" {
+		return fmt.Errorf("%s", reply.Error)
+	}
+	for _, task := range reply.Tasks {
+		fmt.Printf("[%d] %-28s completed:%v running:%v failed:%v\n",
+			task.ID, task.Messages, task.Completed, task.Running, task.Failed)
+	}
+	fmt.Printf("done: %v\n", reply.Done)
+	return nil
+}
+
+func tailLogs(addr, jobID string, taskFilter int) error {
+	conn, err := dial(addr)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+
+	req := api.Request{Cmd: api.CmdStreamLogs, JobID: jobID, TaskFilter: taskFilter}
+	if err := json.NewEncoder(conn).Encode(req); err != nil {
+		return err
+	}
+
+	dec := json.NewDecoder(conn)
+	for {
+		var chunk api.LogChunk
+		if err := dec.Decode(&chunk); err != nil {
+			return nil
+		}
+		if chunk.Done {
+			return nil
+		}
+		fmt.Printf("[%d] %s\n", chunk.TaskID, chunk.Chunk)
+	}
+}
+
+func cancel(addr, jobID string) error {
+	var reply api.CancelReply
+	if err := roundTrip(addr, api.Request{Cmd: api.CmdCancel, JobID: jobID}, &reply); err != nil {
+		return err
+	}
+	if reply.Error != "" {
+		return fmt.Errorf("%s", reply.Error)
+	}
+	fmt.Println("ok")
+	return nil
+}
+
+func list(addr string) error {
+	var reply api.ListReply
+	if err := roundTrip(addr, api.Request{Cmd: api.CmdListRunning}, &reply); err != nil {
+		return err
+	}
+	for _, id := range reply.IDs {
+		fmt.Println(id)
+	}
+	return nil
+}
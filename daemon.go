@@ -0,0 +1,375 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+
+	"github.com/apex/log"
+	"github.com/aubonbeurre/mpbuild/api"
+)
+
+var stateDir = filepath.Join(depDir, "daemon")
+
+// daemonJob is one in-flight (or finished) build tracked by the daemon.
+type daemonJob struct {
+	ID     string
+	Job    *Job
+	Config string
+
+	mu      sync.Mutex
+	done    bool
+	err     error
+	subs    []chan api.LogChunk
+}
+
+// subscribe registers a new log-chunk subscriber and reports whether the
+// job had already finished before this subscriber joined. finish() only
+// ever notifies the subscribers that existed when it ran, so a subscriber
+// arriving afterwards (a trivially-fast or already-up-to-date job racing a
+// client's second round-trip) would otherwise get a channel nothing will
+// ever write to. When alreadyDone is true the returned channel is not
+// registered and the caller must not block reading from it.
+func (dj *daemonJob) subscribe() (ch chan api.LogChunk, alreadyDone bool) {
+	ch = make(chan api.LogChunk, 64)
+	dj.mu.Lock()
+	defer dj.mu.Unlock()
+	if dj.done {
+		return ch, true
+	}
+	dj.subs = append(dj.subs, ch)
+	return ch, false
+}
+
+func (dj *daemonJob) broadcast(chunk api.LogChunk) {
+	dj.mu.Lock()
+	defer dj.mu.Unlock()
+	for _, ch := range dj.subs {
+		select {
+		case ch <- chunk:
+		default:
+			// slow subscriber, drop the line rather than block the build
+		}
+	}
+}
+
+// unsubscribe removes ch from dj.subs, e.g. once a CmdStreamLogs client has
+// disconnected, so finish() and later broadcast()s don't keep trying to
+// feed a channel nothing will ever read again.
+func (dj *daemonJob) unsubscribe(ch chan api.LogChunk) {
+	dj.mu.Lock()
+	defer dj.mu.Unlock()
+	for i, c := range dj.subs {
+		if c == ch {
+			dj.subs = append(dj.subs[:i], dj.subs[i+1:]...)
+			return
+		}
+	}
+}
+
+func (dj *daemonJob) finish(err error) {
+	dj.mu.Lock()
+	dj.done = true
+	dj.err = err
+	subs := dj.subs
+	dj.mu.Unlock()
+	for _, ch := range subs {
+		select {
+		case ch <- api.LogChunk{Done: true}:
+		default:
+			// subscriber already gone or not reading; don't block runJob
+			// on it, and don't leak this goroutine waiting for it.
+		}
+	}
+}
+
+// Cancel kills every currently-running task's xcodebuild child so an
+// in-flight build can be stopped cleanly without tearing down the daemon.
+func (j *Job) Cancel() {
+	for _, task := range j.Tasks {
+		if task.Running && !task.IsCompleted() && task.Proc != nil {
+			task.Proc.Kill()
+		}
+	}
+}
+
+// supervisor owns every job the daemon knows about, mirroring the
+// containerd-shim pattern: a long-lived process holding a mutex-protected
+// registry plus the worker goroutines/channels that used to live in a
+// single run() call.
+type supervisor struct {
+	mu      sync.Mutex
+	jobs    map[string]*daemonJob
+	counter int64
+}
+
+func newSupervisor() *supervisor {
+	return &supervisor{jobs: map[string]*daemonJob{}}
+}
+
+func (s *supervisor) nextID() string {
+	return strconv.FormatInt(atomic.AddInt64(&s.counter, 1), 10)
+}
+
+func (s *supervisor) submit(jobPath string, jobJSON []byte, config string) (string, error) {
+	var job *Job
+	if len(jobJSON) > 0 {
+		if err := json.Unmarshal(jobJSON, &job); err != nil {
+			return "", err
+		}
+	} else {
+		f, err := os.Open(jobPath)
+		if err != nil {
+			return "", err
+		}
+		defer f.Close()
+
+		if err := json.NewDecoder(f).Decode(&job); err != nil {
+			return "", err
+		}
+	}
+
+	id := s.nextID()
+	dj := &daemonJob{ID: id, Job: job, Config: config}
+
+	s.mu.Lock()
+	s.jobs[id] = dj
+	s.mu.Unlock()
+
+	go s.runJob(dj)
+	return id, nil
+}
+
+func (s *supervisor) runJob(dj *daemonJob) {
+	events := make(chan taskEvent, 256)
+	go func() {
+		for ev := range events {
+			dj.broadcast(api.LogChunk{TaskID: ev.TaskID, Chunk: ev.Line})
+			s.persist(dj)
+		}
+	}()
+
+	err := run(dj.Job, dj.Config, events, nil)
+	close(events)
+	if err == nil {
+		printStatsSummary(dj.Job, dj.Config)
+	}
+	dj.finish(err)
+	s.persist(dj)
+}
+
+func (s *supervisor) status(id string) (*daemonJob, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	dj, ok := s.jobs[id]
+	return dj, ok
+}
+
+func (s *supervisor) list() []string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	var ids []string
+	for id, dj := range s.jobs {
+		dj.mu.Lock()
+		running := !dj.done
+		dj.mu.Unlock()
+		if running {
+			ids = append(ids, id)
+		}
+	}
+	return ids
+}
+
+// persist writes the job's current Task slice (which already carries its
+// own Complete/Running/Err state) to stateDir, so a daemon restart can find
+// unfinished jobs and resume them instead of losing in-flight progress.
+func (s *supervisor) persist(dj *daemonJob) {
+	if err := os.MkdirAll(stateDir, 0755); err != nil {
+		return
+	}
+	data, err := json.Marshal(struct {
+		Config string `json:"config"`
+		*Job
+	}{dj.Config, dj.Job})
+	if err != nil {
+		return
+	}
+	path := filepath.Join(stateDir, dj.ID+".json")
+	tmp := path + ".tmp"
+	if err := ioutil.WriteFile(tmp, data, 0644); err != nil {
+		return
+	}
+	os.Rename(tmp, path)
+}
+
+// resumePersisted reloads any job state left behind by a previous daemon
+// process and restarts whichever tasks had not completed yet.
+func (s *supervisor) resumePersisted() {
+	entries, err := ioutil.ReadDir(stateDir)
+	if err != nil {
+		return
+	}
+	for _, entry := range entries {
+		if !strings.HasSuffix(entry.Name(), ".json") {
+			continue
+		}
+		id := strings.TrimSuffix(entry.Name(), ".json")
+		data, err := ioutil.ReadFile(filepath.Join(stateDir, entry.Name()))
+		if err != nil {
+			continue
+		}
+		var state struct {
+			Config string `json:"config"`
+			*Job
+		}
+		if err := json.Unmarshal(data, &state); err != nil || state.Job == nil {
+			continue
+		}
+		job := state.Job
+
+		var remaining bool
+		for _, task := range job.Tasks {
+			task.Running = false
+			if !task.IsCompleted() {
+				remaining = true
+			}
+		}
+		if !remaining {
+			continue
+		}
+
+		log.WithFields(log.Fields{"job_id": id, "remaining": countIncomplete(job)}).Info("daemon resuming job")
+		dj := &daemonJob{ID: id, Job: job, Config: state.Config}
+		s.mu.Lock()
+		s.jobs[id] = dj
+		s.mu.Unlock()
+		go s.runJob(dj)
+	}
+}
+
+func countIncomplete(job *Job) int {
+	var n int
+	for _, task := range job.Tasks {
+		if !task.IsCompleted() {
+			n++
+		}
+	}
+	return n
+}
+
+// runDaemon runs the long-lived supervisor, listening for client
+// connections on a unix socket (e.g. "unix:///tmp/mpbuild.sock").
+func runDaemon(listenAddr string) error {
+	addr := strings.TrimPrefix(listenAddr, "unix://")
+	os.Remove(addr)
+
+	listener, err := net.Listen("unix", addr)
+	if err != nil {
+		return err
+	}
+	defer listener.Close()
+
+	sup := newSupervisor()
+	sup.resumePersisted()
+
+	log.WithFields(log.Fields{"address": listenAddr}).Info("daemon listening")
+	for {
+		conn, err := listener.Accept()
+		if err != nil {
+			return err
+		}
+		go sup.handleConn(conn)
+	}
+}
+
+func (s *supervisor) handleConn(conn net.Conn) {
+	defer conn.Close()
+
+	var req api.Request
+	if err := json.NewDecoder(conn).Decode(&req); err != nil {
+		return
+	}
+
+	enc := json.NewEncoder(conn)
+
+	switch req.Cmd {
+	case api.CmdSubmit:
+		id, err := s.submit(req.JobPath, req.JobJSON, req.Config)
+		reply := api.SubmitReply{JobID: id}
+		if err != nil {
+			reply.Error = err.Error()
+		}
+		enc.Encode(reply)
+
+	case api.CmdGetStatus:
+		dj, ok := s.status(req.JobID)
+		if !ok {
+			enc.Encode(api.StatusReply{Error: fmt.Sprintf("no such job %q", req.JobID)})
+			return
+		}
+		dj.mu.Lock()
+		done, jerr := dj.done, dj.err
+		dj.mu.Unlock()
+
+		reply := api.StatusReply{JobID: dj.ID, Done: done}
+		if jerr != nil {
+			reply.Error = jerr.Error()
+		}
+		for _, task := range dj.Job.Tasks {
+			reply.Tasks = append(reply.Tasks, api.TaskStatus{
+				ID:        task.ID,
+				Messages:  task.Messages,
+				Completed: task.IsCompleted(),
+				Running:   task.Running,
+				Failed:    task.Err != nil,
+			})
+		}
+		enc.Encode(reply)
+
+	case api.CmdStreamLogs:
+		dj, ok := s.status(req.JobID)
+		if !ok {
+			enc.Encode(api.LogChunk{Done: true})
+			return
+		}
+		sub, alreadyDone := dj.subscribe()
+		if alreadyDone {
+			enc.Encode(api.LogChunk{Done: true})
+			return
+		}
+		defer dj.unsubscribe(sub)
+		for chunk := range sub {
+			if req.TaskFilter != 0 && chunk.TaskID != req.TaskFilter && !chunk.Done {
+				continue
+			}
+			if err := enc.Encode(chunk); err != nil {
+				return
+			}
+			if chunk.Done {
+				return
+			}
+		}
+
+	case api.CmdCancel:
+		dj, ok := s.status(req.JobID)
+		if !ok {
+			enc.Encode(api.CancelReply{Error: fmt.Sprintf("no such job %q", req.JobID)})
+			return
+		}
+		dj.Job.Cancel()
+		enc.Encode(api.CancelReply{OK: true})
+
+	case api.CmdListRunning:
+		enc.Encode(api.ListReply{IDs: s.list()})
+
+	default:
+		enc.Encode(api.SubmitReply{Error: fmt.Sprintf("unknown command %q", req.Cmd)})
+	}
+}
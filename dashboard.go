@@ -0,0 +1,337 @@
+package main
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+
+	tea "github.com/charmbracelet/bubbletea"
+	"github.com/charmbracelet/lipgloss"
+)
+
+// taskStage is the lifecycle of a Task as tracked by the dashboard.
+type taskStage int
+
+const (
+	stagePending taskStage = iota
+	stageWaiting
+	stageRunning
+	stageDone
+	stageFailed
+)
+
+func (s taskStage) String() string {
+	switch s {
+	case stagePending:
+		return "Pending"
+	case stageWaiting:
+		return "Waiting-on-deps"
+	case stageRunning:
+		return "Running"
+	case stageDone:
+		return "Done"
+	case stageFailed:
+		return "Failed"
+	default:
+		return "?"
+	}
+}
+
+func (s taskStage) glyph() string {
+	switch s {
+	case stageDone:
+		return lipgloss.NewStyle().Foreground(lipgloss.Color("2")).Render("✓")
+	case stageFailed:
+		return lipgloss.NewStyle().Foreground(lipgloss.Color("1")).Render("✘")
+	case stageRunning:
+		return "▶"
+	default:
+		return "·"
+	}
+}
+
+// taskEvent is emitted by run/workerFetchTask/build and consumed by the
+// dashboard, so the UI never has to poll ps or distccmon-text itself.
+type taskEvent struct {
+	TaskID  int
+	Stage   taskStage
+	Worker  int
+	Cost    int
+	Elapsed time.Duration
+	Line    string
+}
+
+const tailLines = 8
+
+type taskRow struct {
+	task    *Task
+	stage   taskStage
+	worker  int
+	started time.Time
+	elapsed time.Duration
+	tail    []string
+}
+
+func (r *taskRow) pushLine(line string) {
+	r.tail = append(r.tail, line)
+	if len(r.tail) > tailLines {
+		r.tail = r.tail[len(r.tail)-tailLines:]
+	}
+}
+
+type dashboardModel struct {
+	job            *Job
+	config         string
+	rows           map[int]*taskRow
+	events         <-chan taskEvent
+	retry          chan<- int
+	tasksCompleted int
+	costTotal      int
+	costRunning    int
+	cursor         int
+	filterFailing  bool
+	filterText     string
+	filtering      bool
+	pagerTaskID    int
+	err            error
+	done           bool
+}
+
+func newDashboardModel(job *Job, config string, events <-chan taskEvent, retry chan<- int) *dashboardModel {
+	rows := make(map[int]*taskRow, len(job.Tasks))
+	for _, task := range job.Tasks {
+		rows[task.ID] = &taskRow{task: task}
+	}
+	var costTotal int
+	for _, task := range job.Tasks {
+		costTotal += task.Cost
+	}
+	return &dashboardModel{
+		job:         job,
+		config:      config,
+		rows:        rows,
+		events:      events,
+		retry:       retry,
+		costTotal:   costTotal,
+		pagerTaskID: -1,
+	}
+}
+
+type taskEventMsg taskEvent
+
+func waitForEvent(events <-chan taskEvent) tea.Cmd {
+	return func() tea.Msg {
+		ev, ok := <-events
+		if !ok {
+			return nil
+		}
+		return taskEventMsg(ev)
+	}
+}
+
+func (m *dashboardModel) Init() tea.Cmd {
+	return waitForEvent(m.events)
+}
+
+func (m *dashboardModel) orderedRows() []*taskRow {
+	rows := make([]*taskRow, 0, len(m.rows))
+	for _, r := range m.rows {
+		if m.filterFailing && r.stage != stageFailed {
+			continue
+		}
+		if m.filterText != "" && !strings.Contains(strings.ToLower(r.task.Messages), strings.ToLower(m.filterText)) {
+			continue
+		}
+		rows = append(rows, r)
+	}
+	sort.Slice(rows, func(i, j int) bool { return rows[i].task.ID < rows[j].task.ID })
+	return rows
+}
+
+func (m *dashboardModel) Update(msg tea.Msg) (tea.Model, tea.Cmd) {
+	switch msg := msg.(type) {
+	case taskEventMsg:
+		row := m.rows[msg.TaskID]
+		if row != nil {
+			prevStage := row.stage
+			row.stage = msg.Stage
+			if msg.Worker != 0 {
+				row.worker = msg.Worker
+			}
+			if msg.Stage == stageRunning && prevStage != stageRunning {
+				row.started = time.Now()
+			}
+			if msg.Line != "" {
+				row.pushLine(msg.Line)
+			}
+			if msg.Stage == stageDone || msg.Stage == stageFailed {
+				row.elapsed = msg.Elapsed
+				m.tasksCompleted++
+			}
+		}
+		m.costRunning = msg.Cost
+		if m.tasksCompleted >= len(m.job.Tasks) {
+			m.done = true
+			return m, tea.Quit
+		}
+		return m, waitForEvent(m.events)
+
+	case tea.KeyMsg:
+		if m.filtering {
+			switch msg.String() {
+			case "enter", "esc":
+				m.filtering = false
+			case "backspace":
+				if len(m.filterText) > 0 {
+					m.filterText = m.filterText[:len(m.filterText)-1]
+				}
+			default:
+				if len(msg.Runes) > 0 {
+					m.filterText += string(msg.Runes)
+				}
+			}
+			return m, nil
+		}
+
+		if m.pagerTaskID != -1 {
+			switch msg.String() {
+			case "esc", "enter", "q":
+				m.pagerTaskID = -1
+			}
+			return m, nil
+		}
+
+		switch msg.String() {
+		case "ctrl+c", "q":
+			return m, tea.Quit
+		case "f":
+			m.filterFailing = !m.filterFailing
+		case "/":
+			m.filtering = true
+			m.filterText = ""
+		case "up", "k":
+			if m.cursor > 0 {
+				m.cursor--
+			}
+		case "down", "j":
+			if m.cursor < len(m.orderedRows())-1 {
+				m.cursor++
+			}
+		case "enter":
+			rows := m.orderedRows()
+			if m.cursor < len(rows) {
+				m.pagerTaskID = rows[m.cursor].task.ID
+			}
+		case "r":
+			// Without --continue, run() aborts the whole config at the
+			// first task failure, so retrying one task can't save the
+			// build; don't act on it (the footer hides the hint too).
+			if !gOpts.ContinueErr {
+				break
+			}
+			rows := m.orderedRows()
+			if m.cursor < len(rows) && rows[m.cursor].stage == stageFailed && m.retry != nil {
+				m.retry <- rows[m.cursor].task.ID
+				rows[m.cursor].stage = stagePending
+				m.tasksCompleted--
+			}
+		}
+	}
+	return m, nil
+}
+
+var (
+	headerStyle = lipgloss.NewStyle().Bold(true).Foreground(lipgloss.Color("15"))
+	dimStyle    = lipgloss.NewStyle().Foreground(lipgloss.Color("8"))
+	curStyle    = lipgloss.NewStyle().Background(lipgloss.Color("4")).Foreground(lipgloss.Color("15"))
+)
+
+func (m *dashboardModel) View() string {
+	var b strings.Builder
+
+	fmt.Fprintf(&b, "%s  %d/%d tasks  cost %d/%d\n",
+		headerStyle.Render(fmt.Sprintf("mpbuild [%s]", m.config)),
+		m.tasksCompleted, len(m.job.Tasks), m.costRunning, m.costTotal)
+
+	if m.pagerTaskID != -1 {
+		row := m.rows[m.pagerTaskID]
+		fmt.Fprintf(&b, "\n%s\n\n", headerStyle.Render(row.task.Messages))
+		b.WriteString(row.task.Output)
+		b.WriteString(dimStyle.Render("\n[enter/esc to close]\n"))
+		return b.String()
+	}
+
+	if m.filtering {
+		fmt.Fprintf(&b, "filter: %s\n", m.filterText)
+	}
+
+	for i, row := range m.orderedRows() {
+		line := fmt.Sprintf("%s %-28s %-16s worker:%d elapsed:%s", row.stage.glyph(),
+			truncate(row.task.Messages, 28), row.stage.String(), row.worker, elapsedString(row))
+		if i == m.cursor {
+			line = curStyle.Render(line)
+		}
+		b.WriteString(line)
+		b.WriteString("\n")
+		if row.stage == stageRunning && len(row.tail) > 0 {
+			for _, l := range row.tail {
+				b.WriteString(dimStyle.Render("    " + l))
+				b.WriteString("\n")
+			}
+		}
+	}
+
+	hints := "\n[f] filter failing  [/] search  [enter] view log  [q] quit\n"
+	if gOpts.ContinueErr {
+		hints = "\n[f] filter failing  [/] search  [enter] view log  [r] retry  [q] quit\n"
+	}
+	b.WriteString(dimStyle.Render(hints))
+	return b.String()
+}
+
+func elapsedString(row *taskRow) string {
+	if row.stage == stageRunning {
+		return time.Since(row.started).Round(time.Second).String()
+	}
+	if row.elapsed > 0 {
+		return row.elapsed.Round(time.Second).String()
+	}
+	return "-"
+}
+
+func truncate(s string, n int) string {
+	if len(s) <= n {
+		return s
+	}
+	return s[:n-1] + "…"
+}
+
+// runWithDashboard runs job under the bubbletea dashboard instead of the
+// plain terminal/log output, wiring task lifecycle events and log lines
+// straight from run()/workerFetchTask() into the UI over a channel.
+func runWithDashboard(job *Job, config string) error {
+	events := make(chan taskEvent, 256)
+	retry := make(chan int)
+
+	m := newDashboardModel(job, config, events, retry)
+	p := tea.NewProgram(m)
+
+	done := make(chan error, 1)
+	go func() {
+		err := run(job, config, events, retry)
+		close(events)
+		done <- err
+	}()
+
+	// p.Run() can return as soon as the dashboard sees the last
+	// taskEventMsg and quits, which may race ahead of run()'s own
+	// goroutine finishing; always wait for done so a failed build can't be
+	// reported as a nil error.
+	if _, err := p.Run(); err != nil {
+		<-done
+		return err
+	}
+	return <-done
+}
+
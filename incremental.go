@@ -0,0 +1,287 @@
+package main
+
+import (
+	"bufio"
+	"crypto/sha256"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"runtime"
+	"strconv"
+	"strings"
+
+	"github.com/apex/log"
+)
+
+const depDir = ".mpbuild"
+
+// depFilePath returns the path of the redo-style dependency record for a
+// task, keyed by config as well as ID: the same task built for Debug and
+// Release produces different artifacts, so they need independent records.
+func depFilePath(task *Task, config string) string {
+	return filepath.Join(depDir, fmt.Sprintf("%d-%s.dep", task.ID, config))
+}
+
+// hashFile returns a SHA-256 digest of path, truncated to 16 bytes (32 hex chars).
+func hashFile(path string) (string, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+
+	h := sha256.New()
+	if _, err := io.Copy(h, f); err != nil {
+		return "", err
+	}
+	return fmt.Sprintf("%x", h.Sum(nil)[:16]), nil
+}
+
+// depRecord is the parsed form of a <task-id>-<config>.dep file: a flat set of
+// key/value lines, one hash per recorded input (artifact, source file or
+// dependency task).
+type depRecord map[string]string
+
+// loadDepRecord reads a dep-file written by writeDepRecord. A missing or
+// malformed record is treated as "no record" so the caller rebuilds.
+func loadDepRecord(path string) (depRecord, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	rec := depRecord{}
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		line := scanner.Text()
+		if len(strings.TrimSpace(line)) == 0 {
+			continue
+		}
+		parts := strings.SplitN(line, "=", 2)
+		if len(parts) != 2 {
+			return nil, fmt.Errorf("malformed dep record line: %q", line)
+		}
+		rec[parts[0]] = parts[1]
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	return rec, nil
+}
+
+// writeDepRecord atomically (tmp+rename) writes the dep-file for task,
+// recording the artifact hash, the hashes of every source file opened by
+// the build and the hashes of every task it depends on.
+func writeDepRecord(job *Job, task *Task, config, artifact string, sources []string) error {
+	if err := os.MkdirAll(depDir, 0755); err != nil {
+		return err
+	}
+
+	rec := depRecord{}
+
+	if artifactHash, err := hashFile(artifact); err == nil {
+		rec["artifact:"+artifact] = artifactHash
+	} else {
+		log.WithFields(log.Fields{"artifact": artifact, "error": err}).Warn("could not hash artifact")
+	}
+
+	for _, src := range sources {
+		h, err := hashFile(src)
+		if err != nil {
+			continue
+		}
+		rec["src:"+src] = h
+	}
+
+	for _, input := range task.Inputs {
+		dep := job.Tasks[input]
+		h, err := recordHash(dep, config)
+		if err != nil {
+			continue
+		}
+		rec[fmt.Sprintf("dep:%d", dep.ID)] = h
+	}
+
+	tmp, err := ioutil.TempFile(depDir, fmt.Sprintf(".%d-%s.dep.tmp", task.ID, config))
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+
+	w := bufio.NewWriter(tmp)
+	for k, v := range rec {
+		fmt.Fprintf(w, "%s=%s\n", k, v)
+	}
+	if err := w.Flush(); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+
+	return os.Rename(tmp.Name(), depFilePath(task, config))
+}
+
+// recordHash hashes a dependency task's own dep-file, so that a task which
+// depends on task transitively rebuilds if anything upstream changed.
+func recordHash(task *Task, config string) (string, error) {
+	return hashFile(depFilePath(task, config))
+}
+
+// hasSourceEntries reports whether rec recorded at least one source file's
+// hash. A record with none can't prove anything about a task's actual
+// source edits - only that an artifact (or nothing at all) still hashes
+// the same - which happens whenever captureOpenedFiles comes back empty:
+// always on Windows, and on macOS whenever fs_usage can't be started
+// unprivileged.
+func hasSourceEntries(rec depRecord) bool {
+	for key := range rec {
+		if strings.HasPrefix(key, "src:") {
+			return true
+		}
+	}
+	return false
+}
+
+// taskUpToDate reports whether task's dep-file still matches the current
+// state of its artifact, its recorded source files and its dependency
+// tasks. A missing or malformed record, or one with no recorded source
+// files, forces a rebuild rather than vacuously reporting up to date.
+func taskUpToDate(job *Job, task *Task, config string) bool {
+	rec, err := loadDepRecord(depFilePath(task, config))
+	if err != nil {
+		return false
+	}
+
+	if !hasSourceEntries(rec) {
+		return false
+	}
+
+	for key, wantHash := range rec {
+		if strings.HasPrefix(key, "dep:") {
+			id, err := strconv.Atoi(strings.TrimPrefix(key, "dep:"))
+			if err != nil {
+				return false
+			}
+			gotHash, err := recordHash(job.Tasks[id], config)
+			if err != nil || gotHash != wantHash {
+				return false
+			}
+			continue
+		}
+
+		var path string
+		switch {
+		case strings.HasPrefix(key, "artifact:"):
+			path = strings.TrimPrefix(key, "artifact:")
+		case strings.HasPrefix(key, "src:"):
+			path = strings.TrimPrefix(key, "src:")
+		default:
+			return false
+		}
+
+		gotHash, err := hashFile(path)
+		if err != nil || gotHash != wantHash {
+			return false
+		}
+	}
+
+	return true
+}
+
+// artifactPath asks xcodebuild for the build settings of task's target and
+// derives the path of the produced artifact under DerivedData.
+func artifactPath(task *Task, config string) string {
+	if runtime.GOOS == "windows" {
+		return ""
+	}
+
+	projname := strings.Split(filepath.Base(task.MadeProj), ".")[0]
+	target := projname + "." + config
+
+	cmd := exec.Command("xcodebuild", "-project", task.MadeProj, "-target", target,
+		"-configuration", "Default", "-showBuildSettings")
+	out, err := cmd.Output()
+	if err != nil {
+		return ""
+	}
+
+	var builtProductsDir, executablePath string
+	scanner := bufio.NewScanner(strings.NewReader(string(out)))
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		switch {
+		case strings.HasPrefix(line, "BUILT_PRODUCTS_DIR ="):
+			builtProductsDir = strings.TrimSpace(strings.TrimPrefix(line, "BUILT_PRODUCTS_DIR ="))
+		case strings.HasPrefix(line, "EXECUTABLE_PATH ="):
+			executablePath = strings.TrimSpace(strings.TrimPrefix(line, "EXECUTABLE_PATH ="))
+		}
+	}
+	if builtProductsDir == "" || executablePath == "" {
+		return ""
+	}
+	return filepath.Join(builtProductsDir, executablePath)
+}
+
+// captureOpenedFiles traces the files opened by pid for the duration of the
+// build and returns every absolute path it saw that names an existing
+// regular file; paths are not filtered down to project sources. On macOS it
+// shells out to fs_usage, filtered on the child PID; on other platforms
+// there is no equivalent wired up yet and it returns nil.
+func captureOpenedFiles(pid int, done <-chan struct{}) []string {
+	if runtime.GOOS != "darwin" {
+		return nil
+	}
+
+	cmd := exec.Command("fs_usage", "-w", "-f", "filesys", strconv.Itoa(pid))
+	stdout, err := cmd.StdoutPipe()
+	if err != nil {
+		log.WithError(err).Warn("fs_usage unavailable")
+		return nil
+	}
+	if err := cmd.Start(); err != nil {
+		log.WithError(err).Warn("fs_usage unavailable")
+		return nil
+	}
+
+	seen := map[string]bool{}
+	var files []string
+	linesCh := make(chan string)
+	go func() {
+		defer close(linesCh)
+		scanner := bufio.NewScanner(stdout)
+		for scanner.Scan() {
+			linesCh <- scanner.Text()
+		}
+	}()
+
+	for {
+		select {
+		case <-done:
+			cmd.Process.Kill()
+			cmd.Wait()
+			return files
+		case line, ok := <-linesCh:
+			if !ok {
+				cmd.Wait()
+				return files
+			}
+			fields := strings.Fields(line)
+			if len(fields) == 0 {
+				continue
+			}
+			candidate := fields[len(fields)-1]
+			if strings.HasPrefix(candidate, "/") && !seen[candidate] {
+				if info, err := os.Stat(candidate); err == nil && !info.IsDir() {
+					seen[candidate] = true
+					files = append(files, candidate)
+				}
+			}
+		}
+	}
+}
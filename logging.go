@@ -0,0 +1,97 @@
+package main
+
+import (
+	"os"
+	"strings"
+
+	"github.com/apex/log"
+	"github.com/apex/log/handlers/cli"
+	"github.com/apex/log/handlers/json"
+	"github.com/apex/log/handlers/multi"
+)
+
+// workerMessage is one line of xcodebuild output tagged with the task that
+// produced it, so a json log handler can tell parallel workers' output
+// apart instead of receiving one interleaved blob per worker.
+type workerMessage struct {
+	TaskID int
+	Chunk  string
+}
+
+type discardHandler struct{}
+
+func (discardHandler) HandleLog(*log.Entry) error { return nil }
+
+// warnHandler forwards only Warn-and-above entries to inner. --quiet always
+// adds one wrapping a stderr cli handler, so a quiet build still surfaces
+// failures on the terminal regardless of what other handlers are active.
+type warnHandler struct {
+	inner log.Handler
+}
+
+func (h warnHandler) HandleLog(e *log.Entry) error {
+	if e.Level < log.WarnLevel {
+		return nil
+	}
+	return h.inner.HandleLog(e)
+}
+
+// setupLogging wires gOpts.LogLevel/--log/--log-format into apex/log
+// handlers: a colourised cli handler for the terminal (replaced by a
+// Warn/Error-only stderr handler when --quiet is set), a json handler when
+// --log-format=json or a --log file is given, and a multi handler when
+// more than one of those is active. It returns a closer to flush/close the
+// log file, or a no-op func if none was opened.
+func setupLogging() func() {
+	var handlers []log.Handler
+	var logFile *os.File
+
+	if !gOpts.Quiet {
+		handlers = append(handlers, cli.Default)
+	}
+
+	if len(gOpts.Log) > 0 {
+		f, err := os.OpenFile(gOpts.Log, os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0666)
+		if err != nil {
+			log.WithError(err).Fatal("could not open log file")
+		}
+		logFile = f
+		handlers = append(handlers, json.New(f))
+	} else if gOpts.LogFormat == "json" {
+		handlers = append(handlers, json.New(os.Stdout))
+	}
+
+	// --quiet always gets a Warn/Error-only stderr handler alongside
+	// whatever else is configured, not only when it's the sole handler -
+	// otherwise --quiet combined with --log/--log-format=json would hit
+	// "case 1: log.SetHandler(handlers[0])" below, which replaces the
+	// handler outright, and errors would never reach the terminal.
+	if gOpts.Quiet {
+		handlers = append(handlers, warnHandler{inner: cli.New(os.Stderr)})
+	}
+
+	switch len(handlers) {
+	case 0:
+		log.SetHandler(discardHandler{})
+	case 1:
+		log.SetHandler(handlers[0])
+	default:
+		log.SetHandler(multi.New(handlers...))
+	}
+
+	switch strings.ToLower(gOpts.LogLevel) {
+	case "debug":
+		log.SetLevel(log.DebugLevel)
+	case "warn":
+		log.SetLevel(log.WarnLevel)
+	case "error":
+		log.SetLevel(log.ErrorLevel)
+	default:
+		log.SetLevel(log.InfoLevel)
+	}
+
+	if logFile == nil {
+		return func() {}
+	}
+	return func() { logFile.Close() }
+}
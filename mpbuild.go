@@ -1,36 +1,40 @@
 package main
 
 import (
+	"bufio"
 	"encoding/json"
 	"fmt"
-	"log"
 	"os"
 	"os/exec"
 	"path"
 	"path/filepath"
 	"runtime"
 	"strings"
+	"sync"
 	"sync/atomic"
 	"time"
 
+	"github.com/apex/log"
 	"github.com/jessevdk/go-flags"
 )
 
 var gOpts struct {
-	// Slice of bool will append 'true' each time the option
-	// is encountered (can be set multiple times, like -vvv)
-	Verbose     []bool   `short:"v" long:"verbose" description:"Show verbose debug information"`
 	Config      []string `short:"c" long:"config" description:"Specify multiple Debug or Release (default both)"`
 	Log         string   `short:"l" long:"log" description:"Log file"`
+	LogLevel    string   `long:"log-level" default:"info" description:"debug|info|warn|error"`
+	LogFormat   string   `long:"log-format" default:"cli" description:"cli|json"`
 	Ios         bool     `short:"i" long:"ios" description:"ios build"`
 	Quiet       bool     `short:"q" long:"quiet" description:"Suppress most xcodebuild output"`
 	Start       string   `short:"s" long:"start" description:"Start at project <search>"`
 	Only        string   `short:"o" long:"only" description:"Optional comma separated list of projects"`
 	Deps        string   `short:"d" long:"deps" description:"Optional comma separated list of projects"`
 	Not         string   `short:"n" long:"not" description:"Optional comma separated list of projects"`
-	UI          bool     `short:"u" long:"ui" description:"Show a UI for tracking distcc/xcode activity"`
+	UI          bool     `short:"u" long:"ui" description:"Drive the build through an interactive dashboard instead of plain stdout"`
 	ContinueErr bool     `short:"C" long:"continue" description:"Continue on error"`
 	ListPlugins bool     `long:"listplugins" description:"List all plugins"`
+	Rebuild     bool     `short:"r" long:"rebuild-if-changed" description:"Skip tasks whose .mpbuild/<id>-<config>.dep record still matches their inputs"`
+	StatsOut    string   `long:"stats-out" description:"Write a per-task resource-usage/cost-calibration JSON report, one file per config (out.json becomes out.Debug.json)"`
+	Listen      string   `long:"listen" description:"Daemon socket: listened on by 'mpbuild daemon', dialed (or ephemerally spawned) by a plain build (e.g. unix:///tmp/mpbuild.sock)"`
 }
 
 // Job ...
@@ -49,7 +53,7 @@ func checkWinCompiler() (path string) {
 		if _, err := os.Stat(gVS2017Ent); os.IsNotExist(err) {
 			if _, err := os.Stat(gVS2017Ult); os.IsNotExist(err) {
 				if _, err := os.Stat(gVS2015); os.IsNotExist(err) {
-					log.Panic("Could not find VisualStudio!")
+					log.Fatal("Could not find VisualStudio!")
 				} else {
 					return gVS2015
 				}
@@ -86,6 +90,14 @@ type Task struct {
 	Err      error
 	Output   string
 	Start    time.Time
+	Finish   time.Time
+	Artifact string
+	Sources  []string
+
+	ResourceUsage *TaskResourceUsage
+	usageMu       sync.Mutex
+
+	Proc *os.Process
 }
 
 // IsCompleted ...
@@ -122,17 +134,22 @@ func (t *Task) DependsOn(ID int) bool {
 }
 
 func logError(task *Task, msg string, err error) {
-	var s = "mpbuild: " + msg + " (%s) error: %v\n"
-	log.Printf(s, task.Messages, err)
-	if gOpts.Quiet && len(gOpts.Log) > 0 {
-		fmt.Printf(s, task.Messages, err)
-	}
+	log.WithFields(log.Fields{"task": task.Messages, "error": err}).Error(msg)
 }
 
-func build(id int, task *Task, config string) (err error) {
+func build(id int, task *Task, config string, events chan<- taskEvent, messages chan<- workerMessage) (err error) {
 	var projname = strings.Split(filepath.Base(task.MadeProj), ".")[0]
-	log.Printf("mpbuild: START %s|%s (worker %d)\n", projname, config, id)
+	log.WithFields(log.Fields{
+		"project": projname,
+		"config":  config,
+		"worker":  id,
+		"task_id": task.ID,
+		"cost":    task.Cost,
+	}).Info("start")
 	task.Start = time.Now()
+	if events != nil {
+		events <- taskEvent{TaskID: task.ID, Stage: stageRunning, Worker: id}
+	}
 	var cmd *exec.Cmd
 
 	if runtime.GOOS == "windows" {
@@ -143,9 +160,7 @@ func build(id int, task *Task, config string) (err error) {
 			"/projectconfig", config,
 		}
 
-		if len(gOpts.Verbose) > 0 {
-			fmt.Printf("xcodebuild %s\n", strings.Join(args, " "))
-		}
+		log.Debugf("xcodebuild %s", strings.Join(args, " "))
 		cmd = exec.Command(compilerPath, args...)
 	} else {
 		var target = projname + "." + config
@@ -164,47 +179,93 @@ func build(id int, task *Task, config string) (err error) {
 		}
 		args = append(args, "build")
 
-		if len(gOpts.Verbose) > 0 {
-			fmt.Printf("xcodebuild %s\n", strings.Join(args, " "))
-		}
+		log.Debugf("xcodebuild %s", strings.Join(args, " "))
 		cmd = exec.Command("xcodebuild", args...)
 	}
 
-	var stdoutStderr []byte
-	stdoutStderr, err = cmd.CombinedOutput()
-	task.Output = string(stdoutStderr[:])
+	stdout, err := cmd.StdoutPipe()
+	if err != nil {
+		return err
+	}
+	cmd.Stderr = cmd.Stdout
+
+	if err = cmd.Start(); err != nil {
+		return err
+	}
+	task.Proc = cmd.Process
+
+	resourceStop := make(chan struct{})
+	go sampleTaskResources(task, cmd.Process.Pid, resourceStop)
+
+	var fsStop chan struct{}
+	var fsFiles chan []string
+	if gOpts.Rebuild {
+		fsStop = make(chan struct{})
+		fsFiles = make(chan []string, 1)
+		go func(pid int) { fsFiles <- captureOpenedFiles(pid, fsStop) }(cmd.Process.Pid)
+	}
+
+	var out strings.Builder
+	reader := bufio.NewReader(stdout)
+	for {
+		line, rerr := reader.ReadString('\n')
+		if len(line) > 0 {
+			out.WriteString(line)
+			chunk := strings.TrimRight(line, "\n")
+			if events != nil {
+				events <- taskEvent{TaskID: task.ID, Stage: stageRunning, Worker: id, Line: chunk}
+			}
+			if messages != nil {
+				messages <- workerMessage{TaskID: task.ID, Chunk: chunk}
+			}
+		}
+		if rerr != nil {
+			break
+		}
+	}
+
+	err = cmd.Wait()
+	task.Finish = time.Now()
+	close(resourceStop)
+	task.Output = out.String()
+
+	if gOpts.Rebuild {
+		close(fsStop)
+		sources := <-fsFiles
+		if err == nil {
+			task.Artifact = artifactPath(task, config)
+			task.Sources = sources
+		}
+	}
 
 	return err
 }
 
-func workerFetchTask(job *Job, config string, id int, tasks <-chan *Task, results chan<- *Task, messages chan<- string) {
+func workerFetchTask(job *Job, config string, id int, tasks <-chan *Task, results chan<- *Task, messages chan<- workerMessage, events chan<- taskEvent) {
 	for task := range tasks {
 		var err error
-		err = build(id, task, config)
+		err = build(id, task, config, events, messages)
 
 		task.SetCompleted()
 
-		messages <- task.Output
-		task.Output = ""
+		if gOpts.Rebuild && err == nil {
+			if err2 := writeDepRecord(job, task, config, task.Artifact, task.Sources); err2 != nil {
+				log.WithFields(log.Fields{"task": task.Messages, "error": err2}).Warn("could not write dep record")
+			}
+		}
 
 		if err != nil {
 			task.Err = err
 			results <- task
 		} else {
-			//log.Printf("Got one %d\n", j.Number)
 			results <- task
 		}
 	}
 }
 
-func workerStdout(messages <-chan string) {
-	for message := range messages {
-		if !gOpts.Quiet {
-			fmt.Print(message)
-		}
-		if len(gOpts.Log) > 0 {
-			log.Print(message)
-		}
+func workerStdout(messages <-chan workerMessage) {
+	for m := range messages {
+		log.WithFields(log.Fields{"task_id": m.TaskID}).Info(m.Chunk)
 	}
 }
 
@@ -229,19 +290,18 @@ func isIgnoreProject(task *Task) bool {
 	return false
 }
 
-func run(job *Job, config string) (err error) {
+func run(job *Job, config string, events chan<- taskEvent, retry <-chan int) (err error) {
 	var tasks = make(chan *Task, len(job.Tasks))
-	var messages = make(chan string)
+	var messages = make(chan workerMessage)
 	var results = make(chan *Task, len(job.Tasks))
 	var cost int
 	var numRunning int
 	var isAloneLaunched bool
 
-	log.Printf("._%s_.\n", config)
-	fmt.Printf("._%s_.\n", config)
+	log.WithFields(log.Fields{"config": config}).Info("run")
 	go workerStdout(messages)
 	for w := 1; w <= GPrefs.Workers; w++ { //runtime.NumCPU())
-		go workerFetchTask(job, config, w, tasks, results, messages)
+		go workerFetchTask(job, config, w, tasks, results, messages, events)
 	}
 
 	var tasksCompleted int
@@ -250,12 +310,35 @@ func run(job *Job, config string) (err error) {
 		if task.IsCompleted() {
 			tasksCompleted++
 		}
+		if events != nil {
+			stage := stagePending
+			if task.IsCompleted() {
+				stage = stageDone
+			} else if task.HasPendingDeps(job) {
+				stage = stageWaiting
+			}
+			events <- taskEvent{TaskID: task.ID, Stage: stage, Cost: task.Cost}
+		}
 	}
 
 	for tasksCompleted < len(job.Tasks) && err == nil {
 		for _, task := range job.Tasks {
 			if !task.Running && !task.IsCompleted() {
 				if !task.HasPendingDeps(job) {
+					// Checked here, not in a pre-pass, so a task is only
+					// considered up to date once every task it depends on
+					// has actually finished (or been found up to date) in
+					// this run - not against whatever those tasks' dep
+					// records said before this invocation started.
+					if gOpts.Rebuild && taskUpToDate(job, task, config) {
+						log.WithFields(log.Fields{"task": task.Messages, "config": config}).Info("up to date")
+						task.SetCompleted()
+						tasksCompleted++
+						if events != nil {
+							events <- taskEvent{TaskID: task.ID, Stage: stageDone, Cost: cost}
+						}
+						continue
+					}
 					if (!isAloneProject(task) && !isAloneLaunched) || numRunning == 0 {
 						isAloneLaunched = isAloneProject(task)
 						task.Running = true
@@ -282,13 +365,31 @@ func run(job *Job, config string) (err error) {
 						err = err2
 					}
 					logError(task, "Error", err2)
+					if events != nil {
+						events <- taskEvent{TaskID: task.ID, Stage: stageFailed, Cost: cost}
+					}
 				} else {
 					var Elapsed = time.Since(task.Start).Round(time.Duration(time.Second)).String()
-					log.Printf("mpbuild: ->Done %s|%s (%d/%d, cost:%d, time:%s)\n", task.Messages, config, tasksCompleted, len(job.Tasks), cost, Elapsed)
-					if gOpts.Quiet && len(gOpts.Log) > 0 {
-						fmt.Printf("mpbuild: ->Done %s|%s (%d/%d, cost:%d, time:%s)\n", task.Messages, config, tasksCompleted, len(job.Tasks), cost, Elapsed)
+					log.WithFields(log.Fields{
+						"task":      task.Messages,
+						"config":    config,
+						"completed": tasksCompleted,
+						"total":     len(job.Tasks),
+						"cost":      cost,
+						"elapsed":   Elapsed,
+					}).Info("done")
+					if events != nil {
+						events <- taskEvent{TaskID: task.ID, Stage: stageDone, Cost: cost, Elapsed: time.Since(task.Start)}
 					}
 				}
+			case taskID := <-retry:
+				if task := job.Tasks[taskID]; task.Err != nil {
+					atomic.StoreInt32(&task.Complete, 0)
+					task.Running = false
+					task.Err = nil
+					tasksCompleted--
+					log.WithFields(log.Fields{"task": task.Messages, "config": config}).Info("retry")
+				}
 			case <-time.After(time.Second):
 				//fmt.Fprintf(os.Stderr, "Sleeping: %d\n", tasksCompleted)
 				continueFlag = false
@@ -303,22 +404,6 @@ func run(job *Job, config string) (err error) {
 
 var parser = flags.NewParser(&gOpts, flags.Default)
 
-func logSetupAndDestruct() func() {
-	logFile, err := os.OpenFile(gOpts.Log, os.O_CREATE|os.O_APPEND|os.O_RDWR, 0666)
-	if err != nil {
-		log.Panicln(err)
-	}
-
-	log.SetOutput(logFile)
-
-	return func() {
-		e := logFile.Close()
-		if e != nil {
-			fmt.Fprintf(os.Stderr, "Problem closing the log file: %v\n", e)
-		}
-	}
-}
-
 func main() {
 	//runtime.GOMAXPROCS(runtime.NumCPU())
 
@@ -335,20 +420,23 @@ func main() {
 		}
 	}
 
-	if gOpts.UI {
-		runUI()
-		return
-	}
+	defer setupLogging()()
 
-	if len(gOpts.Log) > 0 {
-		defer logSetupAndDestruct()()
+	if len(args) == 1 && args[0] == "daemon" {
+		if len(gOpts.Listen) == 0 {
+			gOpts.Listen = "unix:///tmp/mpbuild.sock"
+		}
+		if err := runDaemon(gOpts.Listen); err != nil {
+			log.WithError(err).Fatal("daemon exited")
+		}
+		return
 	}
 
 	if len(gOpts.Config) == 0 {
 		gOpts.Config = []string{"Debug", "Release"}
 	}
 
-	log.Printf("Configs: %s\n", strings.Join(gOpts.Config, ","))
+	log.Infof("Configs: %s", strings.Join(gOpts.Config, ","))
 
 	for _, jobPath := range args {
 
@@ -472,10 +560,7 @@ func main() {
 			// skip ignored projects
 			for _, task := range job.Tasks {
 				if isIgnoreProject(task) {
-					log.Printf("Skipping ignored project '%s', based on prefs\n", task.Messages)
-					if gOpts.Quiet && len(gOpts.Log) > 0 {
-						fmt.Printf("Skipping ignored project '%s', based on prefs\n", task.Messages)
-					}
+					log.WithFields(log.Fields{"task": task.Messages}).Info("skipping ignored project, based on prefs")
 					task.SetCompleted()
 				}
 			}
@@ -489,8 +574,16 @@ func main() {
 			}
 
 			// build!
-			if err = run(job, config); err != nil {
-				panic(err)
+			if gOpts.UI {
+				err = runWithDashboard(job, config)
+				if err != nil {
+					panic(err)
+				}
+				printStatsSummary(job, config)
+			} else {
+				if err = submitAndWait(job, config); err != nil {
+					panic(err)
+				}
 			}
 		}
 	}
@@ -2,10 +2,10 @@ package main
 
 import (
 	"io/ioutil"
-	"log"
 	"os/user"
 	"path"
 
+	"github.com/apex/log"
 	yaml "gopkg.in/yaml.v2"
 )
 
@@ -56,11 +56,11 @@ func (d *Prefs) Load() {
 		if err = ioutil.WriteFile(prefFile, data, 0600); err != nil {
 			panic(err)
 		}
-		log.Printf("%s created\n", prefFile)
+		log.Infof("%s created", prefFile)
 	} else {
 		if err = yaml.Unmarshal(blob, &GPrefs); err != nil {
 			panic(err)
 		}
-		log.Printf("%s loaded\n", prefFile)
+		log.Infof("%s loaded", prefFile)
 	}
 }
@@ -0,0 +1,200 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/apex/log"
+	gopsprocess "github.com/shirou/gopsutil/process"
+)
+
+// TaskResourceUsage holds the peak/cumulative resource numbers gathered
+// while a Task's xcodebuild (and its child process tree) was running.
+type TaskResourceUsage struct {
+	MaxRSS     uint64        `json:"max_rss"`
+	CPUSeconds float64       `json:"cpu_seconds"`
+	ReadBytes  uint64        `json:"read_bytes"`
+	WriteBytes uint64        `json:"write_bytes"`
+	Threads    int32         `json:"threads"`
+	Wall       time.Duration `json:"wall_ns"`
+}
+
+// LatestTaskStats returns the most recently sampled resource usage for a
+// task, looked up either by numeric ID or by a substring of its Messages.
+func (j *Job) LatestTaskStats(idOrName string) (*TaskResourceUsage, error) {
+	for _, task := range j.Tasks {
+		if fmt.Sprintf("%d", task.ID) == idOrName || strings.Contains(task.Messages, idOrName) {
+			task.usageMu.Lock()
+			defer task.usageMu.Unlock()
+			if task.ResourceUsage == nil {
+				return nil, fmt.Errorf("no resource usage sampled yet for %s", idOrName)
+			}
+			cp := *task.ResourceUsage
+			return &cp, nil
+		}
+	}
+	return nil, fmt.Errorf("no task matching %q", idOrName)
+}
+
+// sampleTaskResources polls pid and all its descendants every ~500ms until stop is
+// closed, keeping a running max RSS / thread count and the latest
+// cumulative CPU and IO counters on task.ResourceUsage.
+func sampleTaskResources(task *Task, pid int, stop <-chan struct{}) {
+	ticker := time.NewTicker(500 * time.Millisecond)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-stop:
+			return
+		case <-ticker.C:
+			u := sampleOnce(pid)
+			if u == nil {
+				continue
+			}
+			task.usageMu.Lock()
+			if prev := task.ResourceUsage; prev != nil {
+				if prev.MaxRSS > u.MaxRSS {
+					u.MaxRSS = prev.MaxRSS
+				}
+				if prev.Threads > u.Threads {
+					u.Threads = prev.Threads
+				}
+			}
+			task.ResourceUsage = u
+			task.usageMu.Unlock()
+		}
+	}
+}
+
+func sampleOnce(pid int) *TaskResourceUsage {
+	proc, err := gopsprocess.NewProcess(int32(pid))
+	if err != nil {
+		return nil
+	}
+
+	procs := []*gopsprocess.Process{proc}
+	for i := 0; i < len(procs); i++ {
+		if children, err := procs[i].Children(); err == nil {
+			procs = append(procs, children...)
+		}
+	}
+
+	var u TaskResourceUsage
+	for _, p := range procs {
+		if mem, err := p.MemoryInfo(); err == nil {
+			u.MaxRSS += mem.RSS
+		}
+		if times, err := p.Times(); err == nil {
+			u.CPUSeconds += times.User + times.System
+		}
+		if ioCounters, err := p.IOCounters(); err == nil {
+			u.ReadBytes += ioCounters.ReadBytes
+			u.WriteBytes += ioCounters.WriteBytes
+		}
+		if threads, err := p.NumThreads(); err == nil {
+			u.Threads += threads
+		}
+	}
+	return &u
+}
+
+// printStatsSummary prints the wall/CPU/RSS table for every task and, when
+// --stats-out is set, writes the same data (plus a recalibrated cost
+// suggestion) as JSON. The output path is namespaced by config so that,
+// with the default "Debug,Release" configs, Release's report doesn't
+// overwrite Debug's.
+func printStatsSummary(job *Job, config string) {
+	fmt.Printf("\nmpbuild: resource usage summary [%s]\n", config)
+	fmt.Printf("%-28s %10s %10s %12s %10s %8s\n", "task", "wall", "cpu", "max_rss", "cost", "new_cost")
+
+	type statsEntry struct {
+		ID       int     `json:"id"`
+		Task     string  `json:"task"`
+		Wall     string  `json:"wall"`
+		CPU      float64 `json:"cpu_seconds"`
+		MaxRSS   uint64  `json:"max_rss"`
+		Cost     int     `json:"cost"`
+		Measured bool    `json:"measured"`
+		NewCost  *int    `json:"new_cost,omitempty"`
+	}
+	var entries []statsEntry
+
+	for _, task := range job.Tasks {
+		task.usageMu.Lock()
+		u := task.ResourceUsage
+		task.usageMu.Unlock()
+
+		measured := !task.Start.IsZero()
+		wall := task.Elapsed()
+		var newCost *int
+		newCostStr := "-"
+		if measured {
+			nc := int(wall.Round(time.Second).Seconds())
+			newCost = &nc
+			newCostStr = fmt.Sprintf("%d", nc)
+		}
+		var cpu float64
+		var rss uint64
+		if u != nil {
+			cpu = u.CPUSeconds
+			rss = u.MaxRSS
+		}
+		fmt.Printf("%-28s %10s %10.1f %12s %10d %8s\n", truncate(task.Messages, 28),
+			wall.Round(time.Second).String(), cpu, humanizeBytes(rss), task.Cost, newCostStr)
+		entries = append(entries, statsEntry{task.ID, task.Messages, wall.String(), cpu, rss, task.Cost, measured, newCost})
+	}
+
+	if len(gOpts.StatsOut) > 0 {
+		data, err := json.MarshalIndent(entries, "", "  ")
+		if err != nil {
+			log.WithError(err).Error("could not marshal stats")
+			return
+		}
+		path := statsOutPath(gOpts.StatsOut, config)
+		if err := ioutil.WriteFile(path, data, 0644); err != nil {
+			log.WithFields(log.Fields{"path": path, "error": err}).Error("could not write stats file")
+		}
+	}
+}
+
+// statsOutPath namespaces --stats-out by config, e.g. "out.json" becomes
+// "out.Debug.json", so building multiple configs in one invocation doesn't
+// have each config's report overwrite the last.
+func statsOutPath(base, config string) string {
+	ext := filepath.Ext(base)
+	return strings.TrimSuffix(base, ext) + "." + config + ext
+}
+
+func humanizeBytes(n uint64) string {
+	const unit = 1024
+	if n < unit {
+		return fmt.Sprintf("%dB", n)
+	}
+	div, exp := uint64(unit), 0
+	for val := n / unit; val >= unit; val /= unit {
+		div *= unit
+		exp++
+	}
+	return fmt.Sprintf("%.1f%ciB", float64(n)/float64(div), "KMGTPE"[exp])
+}
+
+// Elapsed returns how long a task ran for. Once the task has finished this
+// is Finish.Sub(Start), fixed at the moment it actually completed; only
+// while still running does it fall back to time.Since(Start), since Finish
+// isn't set yet. Without that distinction, printStatsSummary (called after
+// every task in the config has finished) would inflate every task but the
+// last-finishing one by however long the rest of the build kept running.
+func (t *Task) Elapsed() time.Duration {
+	if t.Start.IsZero() {
+		return 0
+	}
+	if !t.Finish.IsZero() {
+		return t.Finish.Sub(t.Start)
+	}
+	return time.Since(t.Start)
+}